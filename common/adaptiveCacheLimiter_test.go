@@ -0,0 +1,58 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"math"
+	"runtime/debug"
+	"testing"
+	"time"
+)
+
+// TestAdaptiveCacheLimiterWithoutGOMEMLIMIT guards against the limit ballooning to
+// debug.SetMemoryLimit(-1)'s math.MaxInt64 sentinel when GOMEMLIMIT was never set - azcopy's
+// default today.
+func TestAdaptiveCacheLimiterWithoutGOMEMLIMIT(t *testing.T) {
+	old := debug.SetMemoryLimit(math.MaxInt64)
+	defer debug.SetMemoryLimit(old)
+
+	const startingLimit = 100 << 20
+	c := NewAdaptiveCacheLimiter(10<<20, startingLimit, 0.7, 10*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+
+	if snap := c.Snapshot(); snap.Limit > startingLimit {
+		t.Fatalf("adaptive limit grew past its configured ceiling with GOMEMLIMIT unset: %+v", snap)
+	}
+}
+
+func TestAdaptiveCacheLimiterWithGOMEMLIMIT(t *testing.T) {
+	old := debug.SetMemoryLimit(50 << 20)
+	defer debug.SetMemoryLimit(old)
+
+	const minLimit, startingLimit = 1 << 20, 40 << 20
+	c := NewAdaptiveCacheLimiter(minLimit, startingLimit, 0.5, 10*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+
+	snap := c.Snapshot()
+	if snap.Limit < minLimit || snap.Limit > startingLimit {
+		t.Fatalf("adaptive limit out of its configured [min, starting] bounds: %+v", snap)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// BandwidthLimiter controls bytes-on-the-wire, as a peer to CacheLimiter's control of
+// bytes-in-RAM. It's a thin wrapper around golang.org/x/time/rate, which is where gcsfuse
+// ended up after retiring jacobsa/ratelimit, and gives us the same token-bucket behaviour:
+// a burst can go through immediately, and anything beyond that is paced out over time.
+type BandwidthLimiter interface {
+	// WaitN blocks until count bytes of bandwidth budget are available, or ctx is done.
+	WaitN(ctx context.Context, count int) error
+
+	// Reserve attempts to reserve count bytes right now. If the full reservation isn't
+	// immediately available, it's cancelled (so it doesn't consume future budget) and
+	// retryAfter reports how long the caller would need to wait for it.
+	Reserve(count int) (ok bool, retryAfter time.Duration)
+
+	// ReserveWithDeadline is like Reserve, but fails fast with an error instead of blocking
+	// when the wait would run past deadline. This lets a caller that's already holding
+	// CacheLimiter bytes for a chunk give them back, instead of sitting on RAM while throttled.
+	// When the wait fits before deadline, it sleeps for the wait Reserve reported and returns
+	// nil; on that path no budget is reserved for count.
+	ReserveWithDeadline(count int, deadline time.Time) error
+
+	// SetLimit retunes the limiter at runtime, e.g. in response to a control-channel command.
+	SetLimit(bytesPerSecond int64)
+
+	// Burst returns the limiter's configured burst size, in bytes. x/time/rate.Limiter.WaitN
+	// hard-errors if asked to wait for more than this in one call, so callers driving it with
+	// counts that might exceed burst (e.g. a whole chunk in one Read) need to split on this.
+	Burst() int
+}
+
+type bandwidthLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewBandwidthLimiter creates a BandwidthLimiter capped at bytesPerSecond, with burst bytes
+// of headroom so a chunk can start immediately instead of micro-sleeping on every Read/Write.
+// Callers needing separate upload and download caps should construct one of these for each
+// direction.
+func NewBandwidthLimiter(bytesPerSecond int64, burst int) BandwidthLimiter {
+	return &bandwidthLimiter{limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst)}
+}
+
+func (b *bandwidthLimiter) WaitN(ctx context.Context, count int) error {
+	return b.limiter.WaitN(ctx, count)
+}
+
+func (b *bandwidthLimiter) Reserve(count int) (ok bool, retryAfter time.Duration) {
+	burst := b.limiter.Burst()
+	if burst <= 0 || count <= burst {
+		return b.reserveOne(time.Now(), count)
+	}
+
+	// count exceeds burst, which ReserveN hard-rejects in one call (OK() == false) - split into
+	// burst-sized pieces instead, chaining each piece's reservation time by the cumulative delay
+	// of the pieces before it, so the total retryAfter reflects pacing the whole count rather
+	// than reporting a false "can't be done" for any request bigger than the configured burst.
+	start := time.Now()
+	cursor := start
+	var reservations []*rate.Reservation
+	for remaining := count; remaining > 0; {
+		piece := remaining
+		if piece > burst {
+			piece = burst
+		}
+		r := b.limiter.ReserveN(cursor, piece)
+		if !r.OK() {
+			for i := len(reservations) - 1; i >= 0; i-- {
+				reservations[i].CancelAt(start)
+			}
+			return false, 0
+		}
+		reservations = append(reservations, r)
+		cursor = cursor.Add(r.DelayFrom(cursor))
+		remaining -= piece
+	}
+
+	total := cursor.Sub(start)
+	if total > 0 {
+		// cancel newest-first and as of start: x/time/rate only restores a reservation's tokens
+		// when no later reservation is outstanding and its time to act has not yet passed
+		for i := len(reservations) - 1; i >= 0; i-- {
+			reservations[i].CancelAt(start)
+		}
+		return false, total
+	}
+	return true, 0
+}
+
+func (b *bandwidthLimiter) reserveOne(at time.Time, count int) (ok bool, retryAfter time.Duration) {
+	r := b.limiter.ReserveN(at, count)
+	if !r.OK() {
+		return false, 0
+	}
+	if delay := r.DelayFrom(at); delay > 0 {
+		r.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+func (b *bandwidthLimiter) ReserveWithDeadline(count int, deadline time.Time) error {
+	ok, retryAfter := b.Reserve(count)
+	if ok {
+		return nil
+	}
+	if retryAfter == 0 || time.Now().Add(retryAfter).After(deadline) {
+		return fmt.Errorf("bandwidth reservation for %d bytes would exceed its deadline", count)
+	}
+	time.Sleep(retryAfter)
+	return nil
+}
+
+func (b *bandwidthLimiter) SetLimit(bytesPerSecond int64) {
+	b.limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+func (b *bandwidthLimiter) Burst() int {
+	return b.limiter.Burst()
+}
+
+// waitNInPieces calls bl.WaitN in burst-sized (or smaller) pieces until count bytes of
+// bandwidth budget have been paid for. A single Read or Write can easily cover a whole chunk,
+// which is routinely larger than the configured burst, and WaitN itself errors out rather than
+// pacing when asked for more than burst in one call - so the splitting has to happen here.
+func waitNInPieces(ctx context.Context, bl BandwidthLimiter, count int) error {
+	burst := bl.Burst()
+	if burst <= 0 {
+		return bl.WaitN(ctx, count)
+	}
+	for count > 0 {
+		piece := count
+		if piece > burst {
+			piece = burst
+		}
+		if err := bl.WaitN(ctx, piece); err != nil {
+			return err
+		}
+		count -= piece
+	}
+	return nil
+}
+
+// bandwidthLimitedReader wraps an io.Reader so every Read, once the underlying Read returns,
+// waits for bandwidth budget covering the number of bytes read before handing them back.
+type bandwidthLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	bl  BandwidthLimiter
+}
+
+// NewBandwidthLimitedReader wraps r so that every byte it yields has first passed through bl.
+// Only readers passed to it are limited; it does not wrap the upload or download chunk readers
+// by itself.
+func NewBandwidthLimitedReader(ctx context.Context, r io.Reader, bl BandwidthLimiter) io.Reader {
+	return &bandwidthLimitedReader{ctx: ctx, r: r, bl: bl}
+}
+
+func (r *bandwidthLimitedReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if n > 0 {
+		if waitErr := waitNInPieces(r.ctx, r.bl, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// bandwidthLimitedWriter is the Writer-side equivalent of bandwidthLimitedReader.
+type bandwidthLimitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	bl  BandwidthLimiter
+}
+
+// NewBandwidthLimitedWriter wraps w so that every byte written to it has first passed through bl.
+func NewBandwidthLimitedWriter(ctx context.Context, w io.Writer, bl BandwidthLimiter) io.Writer {
+	return &bandwidthLimitedWriter{ctx: ctx, w: w, bl: bl}
+}
+
+func (w *bandwidthLimitedWriter) Write(p []byte) (n int, err error) {
+	if err := waitNInPieces(w.ctx, w.bl, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
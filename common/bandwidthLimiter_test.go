@@ -0,0 +1,85 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestWaitNInPiecesSplitsAboveBurst guards against x/time/rate.Limiter.WaitN's hard error when
+// asked to wait for more than its configured burst in one call - waitNInPieces must pace such a
+// request across multiple calls instead of handing the raw count straight through.
+func TestWaitNInPiecesSplitsAboveBurst(t *testing.T) {
+	bl := NewBandwidthLimiter(1<<20, 64) // generous rate, tiny burst so 500 bytes exceeds it
+	if err := waitNInPieces(context.Background(), bl, 500); err != nil {
+		t.Fatalf("expected a count above burst to be paced, not rejected: %v", err)
+	}
+}
+
+func TestBandwidthLimitedReaderHandlesReadsAboveBurst(t *testing.T) {
+	const size = 250
+	bl := NewBandwidthLimiter(1<<20, 100) // burst smaller than a single Read of size bytes
+	lr := NewBandwidthLimitedReader(context.Background(), bytes.NewReader(make([]byte, size)), bl)
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(lr, buf); err != nil {
+		t.Fatalf("read of %d bytes (> burst of 100) should have been paced, not rejected: %v", size, err)
+	}
+}
+
+func TestBandwidthLimitedWriterHandlesWritesAboveBurst(t *testing.T) {
+	bl := NewBandwidthLimiter(1<<20, 100) // burst smaller than the single Write below
+	var out bytes.Buffer
+	lw := NewBandwidthLimitedWriter(context.Background(), &out, bl)
+
+	p := make([]byte, 250)
+	if _, err := lw.Write(p); err != nil {
+		t.Fatalf("write of %d bytes (> burst of 100) should have been paced, not rejected: %v", len(p), err)
+	}
+}
+
+// TestBandwidthLimiterReserveAboveBurst guards against Reserve reporting a false "can't be
+// done" for a count larger than the configured burst - it must instead report however long the
+// whole count would take to pace out, the same way waitNInPieces does for WaitN.
+func TestBandwidthLimiterReserveAboveBurst(t *testing.T) {
+	bl := NewBandwidthLimiter(1<<20, 100) // 1MB/s, burst of 100 bytes
+	ok, retryAfter := bl.Reserve(250)
+	if ok {
+		t.Fatal("expected a 250-byte reservation against a 100-byte burst to require waiting, not be immediate")
+	}
+	if retryAfter <= 0 {
+		t.Fatal("expected Reserve to report a positive retryAfter instead of giving up outright")
+	}
+}
+
+// TestBandwidthLimiterReserveWithDeadlineAboveBurst is the regression case for the reported bug:
+// a generous deadline and a generous rate should succeed even though count exceeds burst.
+func TestBandwidthLimiterReserveWithDeadlineAboveBurst(t *testing.T) {
+	bl := NewBandwidthLimiter(1<<30, 100) // 1GB/s, burst of 100 bytes
+	deadline := time.Now().Add(time.Hour)
+	if err := bl.ReserveWithDeadline(250, deadline); err != nil {
+		t.Fatalf("expected a reservation with an hour of slack to succeed, got: %v", err)
+	}
+}
@@ -21,77 +21,315 @@
 package common
 
 import (
-	"math/rand"
-	"sync/atomic"
+	"container/heap"
 	"context"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync"
 	"time"
 )
 
-type Predicate func() bool
+// CachePriority indicates the relative importance of a pending cache admission. When bytes
+// become available (via RemoveBytes), waiters are admitted in priority order, highest first,
+// and FIFO within a given priority, so that a flood of low-priority requests can never starve
+// an earlier, higher- (or equal-) priority one.
+type CachePriority uint8
+
+var ECachePriority = CachePriority(0)
+
+// Control is for control-plane/STE bookkeeping traffic that must never be starved by data chunks.
+func (CachePriority) Control() CachePriority { return CachePriority(0) }
+
+// Normal is for ordinary upload/download chunk data. This is the default priority.
+func (CachePriority) Normal() CachePriority { return CachePriority(1) }
+
+// Speculative is for optimistic/prefetch work that's useful but OK to deprioritize under pressure.
+func (CachePriority) Speculative() CachePriority { return CachePriority(2) }
+
+func (p CachePriority) String() string {
+	switch p {
+	case ECachePriority.Control():
+		return "Control"
+	case ECachePriority.Normal():
+		return "Normal"
+	case ECachePriority.Speculative():
+		return "Speculative"
+	default:
+		return "Unknown"
+	}
+}
 
 // Used to limit the amount of in-flight data in RAM, to keep it an an acceptable level.
 // For downloads, network is producer and disk is consumer, while for uploads the roles are reversed.
 // In either case, if the producer is faster than the consumer, this CacheLimiter is necessary
 // prevent unbounded RAM usage
 type CacheLimiter interface {
-	TryAddBytes(count int64, useRelaxedLimit bool ) (added bool)
-	WaitUntilAddBytes(ctx context.Context, count int64, useRelaxedLimit Predicate) error
-	RemoveBytes(count int64 )
+	TryAddBytes(count int64, priority CachePriority) (added bool)
+	WaitUntilAddBytes(ctx context.Context, count int64, priority CachePriority) error
+	RemoveBytes(count int64)
+	Snapshot() CacheLimiterSnapshot
+}
+
+// CacheLimiterSnapshot is a point-in-time view of a CacheLimiter's state, cheap enough to poll
+// from the STE scheduler or a periodic log line.
+type CacheLimiterSnapshot struct {
+	Value int64 // bytes currently admitted
+	Limit int64 // the limiter's current base limit (adaptive limiters may move this over time)
+}
+
+// cacheLimiterWaiter is one pending WaitUntilAddBytes call, parked on the heap until enough
+// room frees up (or its context is cancelled).
+type cacheLimiterWaiter struct {
+	count    int64
+	priority CachePriority
+	seq      uint64 // enqueue order, used as the tie-breaker within a priority class
+	index    int    // current position in the heap; -1 once removed
+	resultCh chan error
+}
+
+// cacheLimiterHeap orders waiters by priority (lowest value = highest priority), then by
+// enqueue time, so RemoveBytes can always admit the most deserving waiter first.
+type cacheLimiterHeap []*cacheLimiterWaiter
+
+func (h cacheLimiterHeap) Len() int { return len(h) }
+func (h cacheLimiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h cacheLimiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *cacheLimiterHeap) Push(x interface{}) {
+	w := x.(*cacheLimiterWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+func (h *cacheLimiterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	w.index = -1
+	*h = old[:n-1]
+	return w
 }
 
 type cacheLimiter struct {
-	value int64
-	limit int64
+	mu      sync.Mutex
+	value   int64
+	limit   int64
+	waiters cacheLimiterHeap
+	nextSeq uint64
+
+	// adaptive fields - zero value (minAdaptiveLimit == 0) means adaptive mode is off and limit
+	// never moves on its own
+	minAdaptiveLimit   int64
+	maxAdaptiveLimit   int64 // ceiling the limit eases back up to; never exceeded, even if GOMEMLIMIT is unset
+	adaptiveTargetFrac float64
+	gogcLowered        bool
+	savedGOGCPercent   int
+	highPressureStreak int
 }
 
 func NewCacheLimiter(limit int64) CacheLimiter {
 	return &cacheLimiter{limit: limit}
 }
 
-// TryAdd tries to add a memory allocation within the limit.  Returns true if it could be (and was) added
-func (c *cacheLimiter) TryAddBytes(count int64, useRelaxedLimit bool) (added bool) {
-	lim := c.limit
+// NewAdaptiveCacheLimiter creates a CacheLimiter whose effective limit tracks live process
+// memory pressure instead of staying fixed at startup. A background goroutine periodically
+// samples runtime.MemStats against the GOMEMLIMIT soft cap (or MemStats.Sys if unset) and
+// shrinks lim toward minLimit as heap usage approaches targetFraction of that cap, expanding
+// back out as pressure eases. lim never drops below minLimit, so transfers can't deadlock.
+// If pressure stays high for several consecutive samples, GOGC is temporarily lowered to make
+// collections more aggressive, and restored once pressure subsides.
+func NewAdaptiveCacheLimiter(minLimit, startingLimit int64, targetFraction float64, pollInterval time.Duration) CacheLimiter {
+	c := &cacheLimiter{
+		limit:              startingLimit,
+		minAdaptiveLimit:   minLimit,
+		maxAdaptiveLimit:   startingLimit,
+		adaptiveTargetFrac: targetFraction,
+	}
+	go c.runAdaptiveLoop(pollInterval)
+	return c
+}
+
+// runAdaptiveLoop is the background goroutine started by NewAdaptiveCacheLimiter. It runs for
+// the lifetime of the process; CacheLimiters are created once per azcopy invocation, so there's
+// no need for an explicit shutdown path.
+func (c *cacheLimiter) runAdaptiveLoop(pollInterval time.Duration) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.adjustForMemoryPressure()
+	}
+}
+
+func (c *cacheLimiter) adjustForMemoryPressure() {
+	// debug.SetMemoryLimit(-1) is the documented way to read back the current GOMEMLIMIT
+	// without changing it. When GOMEMLIMIT was never set (the azcopy default today), this
+	// returns math.MaxInt64, which isn't a usable basis for a target - fall back to the
+	// process's current Sys (live OS-reserved memory) in that case, per request.
+	softLimit := debug.SetMemoryLimit(-1)
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	basis := softLimit
+	if basis <= 0 || basis == math.MaxInt64 {
+		basis = int64(stats.Sys)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := int64(float64(basis) * c.adaptiveTargetFrac)
+	if target <= 0 {
+		return // can't do anything sensible without a usable target
+	}
+	// never let the adaptively-eased limit exceed the ceiling the caller configured, regardless
+	// of how large the memory-pressure basis above turns out to be
+	if target > c.maxAdaptiveLimit {
+		target = c.maxAdaptiveLimit
+	}
+
+	highPressure := int64(stats.HeapInuse) >= target
+	if highPressure {
+		// shrink proportionally to how far over target we are, but never below the floor
+		overshoot := float64(stats.HeapInuse) / float64(target)
+		newLimit := int64(float64(c.limit) / overshoot)
+		if newLimit < c.minAdaptiveLimit {
+			newLimit = c.minAdaptiveLimit
+		}
+		c.limit = newLimit
 
-	// Above the "strict" limit, there's a bit of extra room, which we use
-	// for high-priority things (i.e. things we deem to be allowable under a relaxed (non-strict) limit)
-	strict := !useRelaxedLimit
-	if strict {
-		lim = int64(float32(lim)  * 0.75)
+		c.highPressureStreak++
+		const highPressureStreakBeforeGCTuning = 3
+		if c.highPressureStreak >= highPressureStreakBeforeGCTuning && !c.gogcLowered {
+			c.savedGOGCPercent = debug.SetGCPercent(50)
+			c.gogcLowered = true
+		}
+	} else {
+		c.highPressureStreak = 0
+		if c.gogcLowered {
+			debug.SetGCPercent(c.savedGOGCPercent)
+			c.gogcLowered = false
+		}
+		// ease back toward the original ceiling now that pressure has dropped
+		if c.limit < target {
+			c.limit = target
+		}
 	}
 
-	if atomic.AddInt64(&c.value, count) <= lim {
+	// a raised limit may now have room for queued waiters; a tightened one leaves them queued
+	c.admitWaitersLocked()
+}
+
+// limitForPriority returns the effective ceiling that applies to an admission at the given
+// priority. Control traffic gets the full limit; everything else leaves some headroom free
+// so that control/STE bookkeeping can never be blocked behind a wave of chunk data.
+func (c *cacheLimiter) limitForPriority(priority CachePriority) int64 {
+	switch priority {
+	case ECachePriority.Control():
+		return c.limit
+	case ECachePriority.Speculative():
+		return int64(float32(c.limit) * 0.5)
+	default: // Normal
+		return int64(float32(c.limit) * 0.75)
+	}
+}
+
+// TryAddBytes tries to add a memory allocation within the limit. Returns true if it could be (and was) added
+func (c *cacheLimiter) TryAddBytes(count int64, priority CachePriority) (added bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tryAddBytesLocked(count, priority)
+}
+
+func (c *cacheLimiter) tryAddBytesLocked(count int64, priority CachePriority) (added bool) {
+	lim := c.limitForPriority(priority)
+	if c.value+count <= lim {
+		c.value += count
 		return true
 	}
-	// else, we are over the limit, so immediately subtract back what we've added, and return false
-	atomic.AddInt64(&c.value, -count)
 	return false
 }
 
-/// WaitToAdd blocks until it completes a successful call to TryAdd
-func (c *cacheLimiter) WaitUntilAddBytes(ctx context.Context, count int64, useRelaxedLimit Predicate) error {
-	for {
-		// Proceed if there's room in the cache
-		if c.TryAddBytes(count, useRelaxedLimit()) {
-			return nil
-		}
+// WaitUntilAddBytes blocks until it completes a successful call to TryAddBytes. Rather than
+// polling, it parks the caller on a priority-ordered heap of waiters and is woken deterministically
+// by RemoveBytes as soon as enough room exists - eliminating the multi-second latency spikes (and
+// arbitrary winner-takes-all ordering) that a randomized retry loop produces.
+func (c *cacheLimiter) WaitUntilAddBytes(ctx context.Context, count int64, priority CachePriority) error {
+	c.mu.Lock()
+	// Only take the immediate fast path when nobody is already queued. If a waiter is already
+	// parked, skipping straight past it here would let a newly-arriving request queue-jump it -
+	// exactly the starvation admitWaitersLocked is designed to prevent.
+	if len(c.waiters) == 0 && c.tryAddBytesLocked(count, priority) {
+		c.mu.Unlock()
+		return nil
+	}
+
+	w := &cacheLimiterWaiter{count: count, priority: priority, seq: c.nextSeq, resultCh: make(chan error, 1)}
+	c.nextSeq++
+	heap.Push(&c.waiters, w)
+	// the new waiter may now head the queue (e.g. a higher priority than those already parked)
+	// and fit right away; admit it here rather than leaving it for the next RemoveBytes
+	c.admitWaitersLocked()
+	c.mu.Unlock()
 
-		// else wait and repeat
-		select {
-		case <-ctx.Done():
+	select {
+	case err := <-w.resultCh:
+		return err
+	case <-ctx.Done():
+		c.mu.Lock()
+		if w.index >= 0 {
+			// still waiting - pull ourselves out of the queue and bail without ever having
+			// touched value
+			heap.Remove(&c.waiters, w.index)
+			c.mu.Unlock()
 			return ctx.Err()
-		case <-time.After(time.Duration(2 * float32(time.Second) * rand.Float32())):
-			// Duration of delay is somewhat arbitrary. Don't want to use anything very tiny (e.g. milliseconds) because that
-			// just adds CPU load for no real benefit.  Is this value too big?  Probably not, because even at 10 Gbps,
-			// it would take longer than this to fill or drain our full memory allocation.
-
-			// Nothing to do, just loop around again
-			// The wait is randomized to prevent the establishment of repetitive oscillations in cache size
-			// Average wait is quite long (2 seconds) since context where we're using this does not require any timing more fine-grained
 		}
+		// we were admitted in the instant between ctx firing and us taking the lock; the bytes
+		// are already reflected in c.value, so give them straight back instead of leaking them
+		c.mu.Unlock()
+		<-w.resultCh
+		c.RemoveBytes(count)
+		return ctx.Err()
 	}
 }
 
+// Snapshot returns the limiter's current value and limit. Safe to call concurrently with any
+// other CacheLimiter method.
+func (c *cacheLimiter) Snapshot() CacheLimiterSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheLimiterSnapshot{Value: c.value, Limit: c.limit}
+}
+
 func (c *cacheLimiter) RemoveBytes(count int64) {
-	negativeDelta := -count
-	atomic.AddInt64(&c.value, negativeDelta)
-}
\ No newline at end of file
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value -= count
+	c.admitWaitersLocked()
+}
+
+// admitWaitersLocked admits waiters strictly head-first: the highest-priority, oldest waiter
+// always gets first refusal on freed-up room, and admission stops the moment that head waiter
+// doesn't fit. Earlier revisions of this kept scanning past a non-fitting head to admit smaller,
+// later-arriving waiters behind it - which let a steady trickle of small admissions starve a
+// single large one indefinitely. Stopping at the first waiter that doesn't fit guarantees the
+// head is never skipped over, at the cost of smaller waiters behind it having to wait their turn.
+func (c *cacheLimiter) admitWaitersLocked() {
+	for len(c.waiters) > 0 {
+		w := c.waiters[0]
+		if !c.tryAddBytesLocked(w.count, w.priority) {
+			return
+		}
+		heap.Pop(&c.waiters)
+		w.resultCh <- nil
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCacheLimiterPriorityOrdering(t *testing.T) {
+	c := NewCacheLimiter(100)
+	if !c.TryAddBytes(100, ECachePriority.Control()) {
+		t.Fatal("expected initial fill to succeed")
+	}
+
+	results := make(chan string, 2)
+	go func() {
+		if err := c.WaitUntilAddBytes(context.Background(), 50, ECachePriority.Speculative()); err == nil {
+			results <- "speculative"
+		}
+	}()
+	time.Sleep(20 * time.Millisecond) // make sure speculative parks on the heap first
+	go func() {
+		if err := c.WaitUntilAddBytes(context.Background(), 50, ECachePriority.Control()); err == nil {
+			results <- "control"
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	c.RemoveBytes(50) // only enough room for one of the two pending 50-byte waiters
+
+	select {
+	case first := <-results:
+		if first != "control" {
+			t.Fatalf("expected higher-priority waiter to be admitted first despite arriving second, got %q", first)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for admission")
+	}
+}
+
+func TestCacheLimiterWaitCancellationDoesNotLeakValue(t *testing.T) {
+	c := NewCacheLimiter(100)
+	// Control is the only priority admitted up to the full limit; Normal is capped at 0.75x.
+	if !c.TryAddBytes(100, ECachePriority.Control()) {
+		t.Fatal("expected initial fill to succeed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := c.WaitUntilAddBytes(ctx, 50, ECachePriority.Normal()); err == nil {
+		t.Fatal("expected the wait to be cancelled by the context deadline")
+	}
+
+	c.RemoveBytes(100)
+	// If the cancelled waiter's count had leaked into value, this would now fail because the
+	// limiter would believe more bytes are in use than actually are.
+	if !c.TryAddBytes(100, ECachePriority.Control()) {
+		t.Fatalf("cache limiter leaked bytes on cancellation, snapshot = %+v", c.Snapshot())
+	}
+}
+
+// TestCacheLimiterLargeWaiterNotStarvedBySmallWaiters guards against a steady trickle of small
+// admissions starving a single large waiter indefinitely: a big waiter parked at the head of the
+// queue must be served before any later, smaller waiter behind it, no matter how many times room
+// frees up in amounts too small for the big one alone.
+func TestCacheLimiterLargeWaiterNotStarvedBySmallWaiters(t *testing.T) {
+	c := NewCacheLimiter(100)
+	if !c.TryAddBytes(100, ECachePriority.Control()) {
+		t.Fatal("expected initial fill to succeed")
+	}
+
+	bigDone := make(chan error, 1)
+	go func() {
+		bigDone <- c.WaitUntilAddBytes(context.Background(), 80, ECachePriority.Control())
+	}()
+	time.Sleep(20 * time.Millisecond) // let the big waiter park at the head of the queue
+
+	var smallDone []chan error
+	for i := 0; i < 5; i++ {
+		c.RemoveBytes(10) // free a little room - never enough, on its own, for the big waiter
+
+		ch := make(chan error, 1)
+		smallDone = append(smallDone, ch)
+		go func() {
+			ch <- c.WaitUntilAddBytes(context.Background(), 5, ECachePriority.Control())
+		}()
+		time.Sleep(15 * time.Millisecond)
+
+		select {
+		case <-bigDone:
+			t.Fatal("big waiter was admitted before enough room had ever freed up for it")
+		default:
+		}
+		for _, sch := range smallDone {
+			select {
+			case err := <-sch:
+				t.Fatalf("small waiter behind the still-blocked big waiter was admitted out of order, err=%v", err)
+			default:
+				// still queued, as expected
+			}
+		}
+	}
+
+	// value is now 100-50=50; free enough additional room for the big waiter to finally fit
+	c.RemoveBytes(30)
+
+	select {
+	case err := <-bigDone:
+		if err != nil {
+			t.Fatalf("big waiter failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the big waiter to finally be admitted")
+	}
+
+	// drain the small waiters so they don't leak past the end of the test
+	c.RemoveBytes(100)
+	for _, sch := range smallDone {
+		select {
+		case err := <-sch:
+			if err != nil {
+				t.Fatalf("small waiter failed: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a small waiter to be admitted after the big one went through")
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrCacheAdmissionTooLarge is returned by a CacheLimiter whose MaxAdmissionSize option is set
+// when a single allocation exceeds that threshold, even if there would otherwise be room for
+// it. Callers should treat this as a signal to fall back to a streaming/non-cached path rather
+// than retrying.
+var ErrCacheAdmissionTooLarge = errors.New("allocation exceeds cache limiter's max admission size")
+
+// hierarchicalCacheLimiter delegates to a parent CacheLimiter (typically the process-wide
+// global one) while also enforcing its own, smaller sub-limit. This lets the jobs-mgr hand each
+// concurrently-running job a scoped limiter that still can't, in aggregate, exceed the global
+// ceiling - so one job full of huge files can't starve every other job's small chunks.
+type hierarchicalCacheLimiter struct {
+	parent           CacheLimiter
+	child            *cacheLimiter
+	maxAdmissionSize int64 // 0 means no per-allocation cap
+}
+
+// HierarchicalCacheLimiterOption configures a hierarchicalCacheLimiter at construction time.
+type HierarchicalCacheLimiterOption func(*hierarchicalCacheLimiter)
+
+// WithMaxAdmissionSize refuses any single allocation larger than maxBytes, even when both the
+// child and parent limiters have room for it. This keeps one outsized chunk from single-
+// handedly consuming a job's whole cache budget; the caller is expected to fall back to a
+// streaming (non-cached) transfer path for allocations this large.
+func WithMaxAdmissionSize(maxBytes int64) HierarchicalCacheLimiterOption {
+	return func(h *hierarchicalCacheLimiter) { h.maxAdmissionSize = maxBytes }
+}
+
+// NewHierarchicalCacheLimiter creates a CacheLimiter scoped to childLimit bytes that also
+// counts every admission against parent. Use this to give each job its own limiter while still
+// respecting a single process-wide cache budget.
+func NewHierarchicalCacheLimiter(parent CacheLimiter, childLimit int64, opts ...HierarchicalCacheLimiterOption) CacheLimiter {
+	h := &hierarchicalCacheLimiter{
+		parent: parent,
+		child:  &cacheLimiter{limit: childLimit},
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func (h *hierarchicalCacheLimiter) TryAddBytes(count int64, priority CachePriority) (added bool) {
+	if h.maxAdmissionSize > 0 && count > h.maxAdmissionSize {
+		return false
+	}
+	if !h.child.TryAddBytes(count, priority) {
+		return false
+	}
+	if h.parent.TryAddBytes(count, priority) {
+		return true
+	}
+	// parent is full; give the bytes back to the child so its own accounting stays correct
+	h.child.RemoveBytes(count)
+	return false
+}
+
+func (h *hierarchicalCacheLimiter) WaitUntilAddBytes(ctx context.Context, count int64, priority CachePriority) error {
+	if h.maxAdmissionSize > 0 && count > h.maxAdmissionSize {
+		return fmt.Errorf("%w: %d bytes requested, max is %d", ErrCacheAdmissionTooLarge, count, h.maxAdmissionSize)
+	}
+	// Wait on the parent - the resource actually shared (and contended) across every job -
+	// before touching the child at all. childLimit belongs to this job alone, so reserving it
+	// up front would hold it hostage from sibling work in the same job for as long as this
+	// request sits blocked on the parent, which is exactly the monopolization problem this
+	// hierarchical limiter exists to prevent one level up.
+	if err := h.parent.WaitUntilAddBytes(ctx, count, priority); err != nil {
+		return err
+	}
+	if err := h.child.WaitUntilAddBytes(ctx, count, priority); err != nil {
+		h.parent.RemoveBytes(count)
+		return err
+	}
+	return nil
+}
+
+func (h *hierarchicalCacheLimiter) RemoveBytes(count int64) {
+	h.child.RemoveBytes(count)
+	h.parent.RemoveBytes(count)
+}
+
+func (h *hierarchicalCacheLimiter) Snapshot() CacheLimiterSnapshot {
+	return h.child.Snapshot()
+}
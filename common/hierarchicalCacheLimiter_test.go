@@ -0,0 +1,78 @@
+// Copyright © 2017 Microsoft <wastore@microsoft.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestHierarchicalCacheLimiterDoesNotStarveSiblingsWhileBlockedOnParent guards against a large
+// request holding its job's whole childLimit hostage while it waits on a parent without room for
+// it - an unrelated, smaller request against the same child should still see its local headroom.
+func TestHierarchicalCacheLimiterDoesNotStarveSiblingsWhileBlockedOnParent(t *testing.T) {
+	parent := NewCacheLimiter(1000)
+	// Control is the only priority admitted up to the full limit; Normal is capped at 0.75x,
+	// so filling/requesting at Normal here would fail the setup itself rather than exercise
+	// what this test is actually about.
+	// Leave 10 bytes free in the parent: room for the small sibling request below, not for the
+	// big one. Had the big request reserved its 995 child bytes up front, 995+10 would exceed the
+	// child's 1000 and the sibling would be refused.
+	if !parent.TryAddBytes(990, ECachePriority.Control()) {
+		t.Fatal("expected to nearly fill the parent")
+	}
+
+	child := NewHierarchicalCacheLimiter(parent, 1000)
+
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- child.WaitUntilAddBytes(context.Background(), 995, ECachePriority.Control())
+	}()
+	time.Sleep(20 * time.Millisecond) // let the big request park on the parent
+
+	if !child.TryAddBytes(10, ECachePriority.Control()) {
+		t.Fatal("sibling request starved of child headroom while another waiter is blocked on the parent")
+	}
+	child.RemoveBytes(10)
+
+	parent.RemoveBytes(990) // let the big request through
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Fatalf("big request failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the big request to be admitted")
+	}
+}
+
+func TestHierarchicalCacheLimiterMaxAdmissionSize(t *testing.T) {
+	parent := NewCacheLimiter(1000)
+	child := NewHierarchicalCacheLimiter(parent, 1000, WithMaxAdmissionSize(100))
+
+	if child.TryAddBytes(101, ECachePriority.Normal()) {
+		t.Fatal("expected an allocation above MaxAdmissionSize to be refused even though room exists")
+	}
+	if !child.TryAddBytes(100, ECachePriority.Normal()) {
+		t.Fatal("expected an allocation at exactly MaxAdmissionSize to be admitted")
+	}
+}